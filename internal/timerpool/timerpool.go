@@ -0,0 +1,54 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package timerpool provides a sync.Pool of *time.Timer so that long-running
+// select loops (like the ones in the leader package) can avoid the
+// allocation and GC churn of repeatedly calling time.After or time.NewTimer:
+// a timer created by time.After is not collected until it fires, so a busy
+// select loop that takes the non-timer branch most of the time steadily
+// leaks timers until it does.
+package timerpool
+
+import (
+	"sync"
+	"time"
+)
+
+var pool sync.Pool
+
+// Get returns a timer that fires after duration d, reusing a previously
+// Put timer when one is available instead of allocating a new one.
+func Get(d time.Duration) *time.Timer {
+	if v := pool.Get(); v != nil {
+		t := v.(*time.Timer)
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// Put stops t and returns it to the pool for reuse. The caller must not
+// use t after calling Put, and must not call Put unless t came from Get.
+func Put(t *time.Timer) {
+	if !t.Stop() {
+		// drain the channel so a subsequent Reset in Get starts clean
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	pool.Put(t)
+}
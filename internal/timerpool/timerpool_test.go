@@ -0,0 +1,65 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package timerpool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetFiresAfterDuration(t *testing.T) {
+	timer := Get(10 * time.Millisecond)
+	defer Put(timer)
+
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatal("timer from Get did not fire")
+	}
+}
+
+func TestPutAllowsReuse(t *testing.T) {
+	first := Get(time.Minute)
+	Put(first)
+
+	second := Get(10 * time.Millisecond)
+	defer Put(second)
+
+	select {
+	case <-second.C:
+	case <-time.After(time.Second):
+		t.Fatal("reused timer did not fire with its new duration")
+	}
+}
+
+// TestPutDrainsFiredTimer ensures Put can be called on a timer whose
+// channel has already fired but was never drained, the case Stop's return
+// value tells callers about.
+func TestPutDrainsFiredTimer(t *testing.T) {
+	timer := Get(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	Put(timer)
+
+	reused := Get(10 * time.Millisecond)
+	defer Put(reused)
+	select {
+	case <-reused.C:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire after being recycled from a fired timer")
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backend defines the storage abstraction leader election is built
+// on top of, and the concrete etcd v2 and v3 implementations of it.
+package backend
+
+import (
+	"context"
+	"time"
+)
+
+// Backend defines the minimal set of key-value operations the leader
+// package needs from an underlying coordination store in order to run
+// its election, voter and watch loops. Implementations exist for etcd v2
+// (backend/etcdv2) and etcd v3 (backend/etcdv3); a Consul-backed
+// implementation can be added the same way without touching leader.go.
+type Backend interface {
+	// Get returns the current value for key, or a not found error if the
+	// key does not exist.
+	Get(ctx context.Context, key string) (*KeyValue, error)
+	// CompareAndSwap sets key to value with the given ttl, but only if the
+	// key's current value equals prevValue. If prevValue is empty, the
+	// swap only succeeds when the key does not already exist.
+	CompareAndSwap(ctx context.Context, key, value, prevValue string, ttl time.Duration) (*KeyValue, error)
+	// Watch starts watching key for changes starting after the given
+	// revision (0 means "from the latest value").
+	Watch(ctx context.Context, key string, revision int64) (Watch, error)
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// KeyValue is the value stored at a key together with the metadata needed
+// to detect changes (Revision) and lease expiry (Expires).
+type KeyValue struct {
+	// Key is the name of the key this value was read from
+	Key string
+	// Value is the value of the key
+	Value string
+	// Revision identifies the version of the key this value corresponds
+	// to, and is used as the starting point for a subsequent Watch
+	Revision int64
+	// Expires is the point in time the key's lease expires, the zero
+	// value if the key does not expire
+	Expires time.Time
+	// PrevValue is the value the key held immediately before this one,
+	// populated by Watch so callers can suppress no-op notifications.
+	// It is always empty for the result of Get and CompareAndSwap.
+	PrevValue string
+}
+
+// Watch streams changes to the value of a key
+type Watch interface {
+	// Next blocks until the next change is available and returns it, or
+	// returns an error if the watch failed or was closed
+	Next(ctx context.Context) (*KeyValue, error)
+	// Close stops the watch and releases its resources
+	Close()
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package etcdv2 implements the leader backend.Backend interface on top of
+// the deprecated etcd v2 HTTP KeysAPI. This is the historical transport the
+// leader package used exclusively before the backend.Backend abstraction
+// was introduced, preserved here for compatibility.
+package etcdv2
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/trace"
+	"go.etcd.io/etcd/client"
+)
+
+// New returns a new etcd v2 backend wrapping the given client
+func New(clt client.Client) backend.Backend {
+	return &etcdBackend{
+		api: client.NewKeysAPI(clt),
+	}
+}
+
+type etcdBackend struct {
+	api client.KeysAPI
+}
+
+// Get returns the current value for key
+func (r *etcdBackend) Get(ctx context.Context, key string) (*backend.KeyValue, error) {
+	resp, err := r.api.Get(ctx, key, nil)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	kv := toKeyValue(resp.Node)
+	// a Watch started from this value uses Response.Index rather than the
+	// node's ModifiedIndex, see Watch
+	kv.Revision = int64(resp.Index)
+	return kv, nil
+}
+
+// CompareAndSwap sets key to value with the given ttl, succeeding only if
+// the key's current value equals prevValue (or the key is absent when
+// prevValue is empty)
+func (r *etcdBackend) CompareAndSwap(ctx context.Context, key, value, prevValue string, ttl time.Duration) (*backend.KeyValue, error) {
+	opts := &client.SetOptions{TTL: ttl}
+	if prevValue == "" {
+		opts.PrevExist = client.PrevNoExist
+	} else {
+		opts.PrevValue = prevValue
+	}
+	resp, err := r.api.Set(ctx, key, value, opts)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return toKeyValue(resp.Node), nil
+}
+
+// Watch starts watching key for changes after the given revision (the v2
+// API calls this the "index"). A revision of 0 means "watch from now".
+func (r *etcdBackend) Watch(ctx context.Context, key string, revision int64) (backend.Watch, error) {
+	opts := &client.WatcherOptions{}
+	if revision != 0 {
+		// Response.Index corresponds to X-Etcd-Index response header field
+		// and is the recommended starting point after a history miss of
+		// over 1000 events
+		opts.AfterIndex = uint64(revision)
+	}
+	return &etcdWatch{watcher: r.api.Watcher(key, opts)}, nil
+}
+
+// Close is a no-op for the v2 backend: the underlying client.Client is
+// owned by the caller and outlives individual backends
+func (r *etcdBackend) Close() error {
+	return nil
+}
+
+type etcdWatch struct {
+	watcher client.Watcher
+}
+
+func (r *etcdWatch) Next(ctx context.Context) (*backend.KeyValue, error) {
+	resp, err := r.watcher.Next(ctx)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	kv := toKeyValue(resp.Node)
+	if resp.PrevNode != nil {
+		kv.PrevValue = resp.PrevNode.Value
+	}
+	return kv, nil
+}
+
+func (r *etcdWatch) Close() {
+	// the v2 client.Watcher has no Close/Cancel method of its own;
+	// cancelling the context passed to Next is how callers stop it
+}
+
+func toKeyValue(node *client.Node) *backend.KeyValue {
+	kv := &backend.KeyValue{
+		Key:      node.Key,
+		Value:    node.Value,
+		Revision: int64(node.ModifiedIndex),
+	}
+	if node.Expiration != nil {
+		kv.Expires = *node.Expiration
+	}
+	return kv
+}
+
+func convertError(err error) error {
+	if isNotFound(err) {
+		return trace.NotFound(err.Error())
+	}
+	if isCompareFailed(err) {
+		return trace.CompareFailed(err.Error())
+	}
+	if isWatchExpired(err) {
+		return trace.CompareFailed(err.Error())
+	}
+	return trace.Wrap(err)
+}
+
+// isNotFound returns true if err indicates the key does not exist
+func isNotFound(err error) bool {
+	e, ok := err.(client.Error)
+	return ok && e.Code == client.ErrorCodeKeyNotFound
+}
+
+// isCompareFailed returns true if err indicates a CompareAndSwap lost the
+// race: either the key's value no longer matched prevValue, or (when
+// prevValue is empty, i.e. PrevNoExist) the key was created concurrently
+func isCompareFailed(err error) bool {
+	e, ok := err.(client.Error)
+	return ok && (e.Code == client.ErrorCodeTestFailed || e.Code == client.ErrorCodeNodeExist)
+}
+
+// isWatchExpired returns true if err indicates the watch's starting index
+// fell out of etcd's event history window and must be re-established
+func isWatchExpired(err error) bool {
+	e, ok := err.(client.Error)
+	return ok && e.Code == client.ErrorCodeEventIndexCleared
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package etcdv3 implements the leader backend.Backend interface on top of
+// the etcd v3 gRPC API, using leases for expiry and transactions for
+// compare-and-swap instead of the v2 PrevValue/PrevIndex semantics.
+package etcdv3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// New returns a new etcd v3 backend wrapping the given client
+func New(clt *clientv3.Client) backend.Backend {
+	return &etcdBackend{
+		client: clt,
+		leases: make(map[string]clientv3.LeaseID),
+	}
+}
+
+type etcdBackend struct {
+	client *clientv3.Client
+
+	mu sync.Mutex
+	// leases tracks the most recently granted lease backing each key, so a
+	// renewal (leader.Session calls CompareAndSwap again with the same
+	// value as prevValue on a term/5 keepalive tick once less than term/2
+	// of the key's lease remains) can be kept alive with KeepAliveOnce
+	// instead of granting and attaching a brand new lease every time.
+	leases map[string]clientv3.LeaseID
+}
+
+// Get returns the current value for key
+func (r *etcdBackend) Get(ctx context.Context, key string) (*backend.KeyValue, error) {
+	resp, err := r.client.Get(ctx, key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, trace.NotFound("key %v not found", key)
+	}
+	return r.toKeyValue(ctx, resp.Kvs[0])
+}
+
+// CompareAndSwap sets key to value with the given ttl, succeeding only if
+// the key's current value equals prevValue (or the key is absent when
+// prevValue is empty). The ttl is implemented with a lease attached to the
+// write; a renewal (prevValue == value, the common case of
+// leader.Session's term/5 keepalive ticks) extends the key's existing
+// lease with KeepAliveOnce rather than granting a new one every time.
+func (r *etcdBackend) CompareAndSwap(ctx context.Context, key, value, prevValue string, ttl time.Duration) (*backend.KeyValue, error) {
+	leaseID, granted, err := r.leaseFor(ctx, key, ttl)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var cmp clientv3.Cmp
+	if prevValue == "" {
+		cmp = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	} else {
+		cmp = clientv3.Compare(clientv3.Value(key), "=", prevValue)
+	}
+	put := clientv3.OpPut(key, value, clientv3.WithLease(leaseID))
+	resp, err := r.client.Txn(ctx).If(cmp).Then(put).Commit()
+	if err != nil {
+		if granted {
+			r.revokeLease(leaseID)
+		}
+		return nil, trace.Wrap(err)
+	}
+	if !resp.Succeeded {
+		if granted {
+			r.revokeLease(leaseID)
+		}
+		return nil, trace.CompareFailed("key %v was concurrently modified", key)
+	}
+	r.mu.Lock()
+	r.leases[key] = leaseID
+	r.mu.Unlock()
+	return r.Get(ctx, key)
+}
+
+// leaseFor returns the lease to attach key's write to. If key already has a
+// live lease from a previous CompareAndSwap and it is still renewable, it
+// is extended with KeepAliveOnce and reused (granted is false). Otherwise a
+// fresh lease is granted (granted is true), e.g. on a key's first write or
+// once its previous lease has expired.
+func (r *etcdBackend) leaseFor(ctx context.Context, key string, ttl time.Duration) (leaseID clientv3.LeaseID, granted bool, err error) {
+	if ttl <= 0 {
+		return 0, false, nil
+	}
+	r.mu.Lock()
+	leaseID, ok := r.leases[key]
+	r.mu.Unlock()
+	if ok {
+		if _, err := r.client.KeepAliveOnce(ctx, leaseID); err == nil {
+			return leaseID, false, nil
+		}
+		r.forgetLease(key)
+	}
+	lease, err := r.client.Grant(ctx, int64(ttl.Seconds()))
+	if err != nil {
+		return 0, false, trace.Wrap(err)
+	}
+	return lease.ID, true, nil
+}
+
+func (r *etcdBackend) forgetLease(key string) {
+	r.mu.Lock()
+	delete(r.leases, key)
+	r.mu.Unlock()
+}
+
+// revokeLease releases a lease granted for a CompareAndSwap call that did
+// not end up attached to any key, e.g. because the transaction's If failed.
+// Revoke is best-effort: a lease that is never revoked simply expires on
+// its own after ttl, so a failure here is not worth surfacing to the
+// caller.
+func (r *etcdBackend) revokeLease(leaseID clientv3.LeaseID) {
+	if leaseID == 0 {
+		return
+	}
+	if _, err := r.client.Revoke(context.Background(), leaseID); err != nil {
+		log.Warnf("failed to revoke lease %x: %v", leaseID, err)
+	}
+}
+
+// Watch starts watching key for changes after the given revision. A
+// revision of 0 watches starting from the current revision.
+func (r *etcdBackend) Watch(ctx context.Context, key string, revision int64) (backend.Watch, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	opts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if revision != 0 {
+		opts = append(opts, clientv3.WithRev(revision+1))
+	}
+	return &etcdWatch{
+		backend: r,
+		events:  r.client.Watch(ctx, key, opts...),
+		cancel:  cancel,
+	}, nil
+}
+
+// Close releases the underlying clientv3.Client
+func (r *etcdBackend) Close() error {
+	return r.client.Close()
+}
+
+func (r *etcdBackend) toKeyValue(ctx context.Context, kv *mvccpb.KeyValue) (*backend.KeyValue, error) {
+	result := &backend.KeyValue{
+		Key:      string(kv.Key),
+		Value:    string(kv.Value),
+		Revision: kv.ModRevision,
+	}
+	if kv.Lease != 0 {
+		ttl, err := r.client.TimeToLive(ctx, clientv3.LeaseID(kv.Lease))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if ttl.TTL > 0 {
+			result.Expires = time.Now().Add(time.Duration(ttl.TTL) * time.Second)
+		}
+	}
+	return result, nil
+}
+
+type etcdWatch struct {
+	backend *etcdBackend
+	events  clientv3.WatchChan
+	cancel  context.CancelFunc
+}
+
+func (r *etcdWatch) Next(ctx context.Context) (*backend.KeyValue, error) {
+	select {
+	case resp, ok := <-r.events:
+		if !ok {
+			return nil, trace.ConnectionProblem(nil, "watch closed")
+		}
+		if err := resp.Err(); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if len(resp.Events) == 0 {
+			return nil, trace.CompareFailed("empty watch response")
+		}
+		event := resp.Events[len(resp.Events)-1]
+		var prevValue string
+		if event.PrevKv != nil {
+			prevValue = string(event.PrevKv.Value)
+		}
+		if event.Type == clientv3.EventTypeDelete {
+			return &backend.KeyValue{Key: string(event.Kv.Key), Revision: resp.Header.Revision, PrevValue: prevValue}, nil
+		}
+		kv, err := r.backend.toKeyValue(ctx, event.Kv)
+		if err != nil {
+			return nil, err
+		}
+		kv.PrevValue = prevValue
+		return kv, nil
+	case <-ctx.Done():
+		return nil, trace.Wrap(ctx.Err())
+	}
+}
+
+func (r *etcdWatch) Close() {
+	r.cancel()
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultDetectHealthyInterval is how often a watch loop checks
+	// whether it has seen an event recently
+	defaultDetectHealthyInterval = 10 * time.Second
+	// defaultWatchLoopUnhealthyTimeout is how long a watch loop is
+	// allowed to go without delivering an event before it is considered
+	// stuck
+	defaultWatchLoopUnhealthyTimeout = 60 * time.Second
+)
+
+// watchMonitor detects a wedged watch loop: a watcher whose underlying
+// stream has gone half-open so Next blocks forever without an event or an
+// error. It is inspired by the leadership watch loop health check in
+// github.com/tikv/pd: a ticker periodically compares the time since the
+// last delivered event against an unhealthy threshold, and if it has been
+// exceeded, probes the backend directly and cancels the current watch so
+// the caller reconnects.
+type watchMonitor struct {
+	client *Client
+	prefix string
+	key    string
+
+	ticker *time.Ticker
+	doneC  chan struct{}
+
+	mu          sync.Mutex
+	lastHealthy time.Time
+	watchCancel context.CancelFunc
+}
+
+// newWatchMonitor starts a health check for a single AddWatch goroutine.
+// ctx is the overall watch context (tied to Client.closeC); the monitor
+// exits when it is cancelled.
+func newWatchMonitor(client *Client, ctx context.Context, prefix, key string) *watchMonitor {
+	m := &watchMonitor{
+		client:      client,
+		prefix:      prefix,
+		key:         key,
+		ticker:      time.NewTicker(client.detectHealthyInterval),
+		doneC:       make(chan struct{}),
+		lastHealthy: time.Now(),
+	}
+	go m.run(ctx)
+	return m
+}
+
+// touch records that the watch loop has just made progress (delivered an
+// event or successfully re-established the watch)
+func (m *watchMonitor) touch() {
+	m.mu.Lock()
+	m.lastHealthy = time.Now()
+	m.mu.Unlock()
+}
+
+// setCancel records the cancel function for the watch currently in flight,
+// so the monitor can tear it down if it wedges
+func (m *watchMonitor) setCancel(cancel context.CancelFunc) {
+	m.mu.Lock()
+	m.watchCancel = cancel
+	m.mu.Unlock()
+}
+
+// stop releases the monitor's resources
+func (m *watchMonitor) stop() {
+	m.ticker.Stop()
+	close(m.doneC)
+}
+
+func (m *watchMonitor) run(ctx context.Context) {
+	for {
+		select {
+		case <-m.ticker.C:
+			m.check(ctx)
+		case <-m.doneC:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *watchMonitor) check(ctx context.Context) {
+	m.mu.Lock()
+	sinceHealthy := time.Since(m.lastHealthy)
+	cancel := m.watchCancel
+	m.mu.Unlock()
+
+	if sinceHealthy <= m.client.watchLoopUnhealthyTimeout {
+		return
+	}
+
+	log.Warningf("%v watch loop unhealthy for %v, probing %v", m.prefix, sinceHealthy, m.key)
+	probeCtx, probeCancel := context.WithTimeout(ctx, m.client.detectHealthyInterval)
+	_, err := m.client.backend.Get(probeCtx, m.key)
+	probeCancel()
+	if err != nil && !trace.IsNotFound(err) {
+		log.Warningf("%v health probe failed: %v", m.prefix, err)
+	}
+
+	// whether or not the probe succeeded, the watch itself has not
+	// delivered anything for longer than the unhealthy timeout, so tear
+	// it down and let the caller reconnect
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/trace"
+)
+
+// stuckWatchBackend's Watch never delivers an event and never returns on
+// its own: Next only unblocks once its watchCtx is cancelled. It exists to
+// exercise the watchMonitor's job of noticing a wedged watch loop and
+// cancelling it so addWatch reconnects.
+type stuckWatchBackend struct {
+	mu         sync.Mutex
+	kv         backend.KeyValue
+	watchCalls int32
+}
+
+func (b *stuckWatchBackend) Get(ctx context.Context, key string) (*backend.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kv := b.kv
+	return &kv, nil
+}
+
+func (b *stuckWatchBackend) CompareAndSwap(ctx context.Context, key, value, prevValue string, ttl time.Duration) (*backend.KeyValue, error) {
+	return nil, trace.NotImplemented("stuckWatchBackend does not support CompareAndSwap")
+}
+
+func (b *stuckWatchBackend) Watch(ctx context.Context, key string, revision int64) (backend.Watch, error) {
+	atomic.AddInt32(&b.watchCalls, 1)
+	return &stuckWatch{ctx: ctx}, nil
+}
+
+func (b *stuckWatchBackend) Close() error { return nil }
+
+type stuckWatch struct {
+	ctx context.Context
+}
+
+func (w *stuckWatch) Next(ctx context.Context) (*backend.KeyValue, error) {
+	<-ctx.Done()
+	return nil, trace.Wrap(ctx.Err())
+}
+
+func (w *stuckWatch) Close() {}
+
+// TestHealthMonitorReconnectsStuckWatch confirms a watch that stops
+// delivering events for longer than WatchLoopUnhealthyTimeout gets its
+// watchCtx cancelled by the health monitor, forcing addWatch to
+// re-establish a fresh backend.Watch rather than blocking on Next forever.
+func TestHealthMonitorReconnectsStuckWatch(t *testing.T) {
+	b := &stuckWatchBackend{kv: backend.KeyValue{Key: "/test/key", Value: "leader"}}
+	clt, err := NewClient(Config{
+		Backend:                   b,
+		DetectHealthyInterval:     10 * time.Millisecond,
+		WatchLoopUnhealthyTimeout: 30 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer clt.Close()
+
+	valuesC := make(chan string, 1)
+	clt.AddWatch("/test/key", 10*time.Millisecond, valuesC)
+
+	select {
+	case <-valuesC:
+	case <-time.After(time.Second):
+		t.Fatal("AddWatch never delivered the initial value")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&b.watchCalls) >= 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("health monitor never reconnected a stuck watch: Watch called %d time(s)", atomic.LoadInt32(&b.watchCalls))
+}
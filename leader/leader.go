@@ -18,30 +18,44 @@ package leader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/gravitational/coordinate/internal/timerpool"
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/coordinate/leader/backend/etcdv2"
 	"github.com/gravitational/trace"
 	"github.com/jonboulle/clockwork"
 	log "github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/client"
 )
 
-// Client implements ETCD-backed leader election client
-// that helps to elect new leaders for a given key and
-// monitors the changes to the leaders
+// Client implements a backend-agnostic leader election client that helps
+// to elect new leaders for a given key and monitors the changes to the
+// leaders. The store it talks to is abstracted behind backend.Backend, so
+// the same election, voter and watch loops run unchanged over etcd v2,
+// etcd v3 or any other backend.Backend implementation.
 type Client struct {
-	client client.Client
-	clock  clockwork.Clock
-	closeC chan struct{}
-	pauseC chan bool
-	closed uint32
+	backend backend.Backend
+	clock   clockwork.Clock
+	closeC  chan struct{}
+	pauseC  chan bool
+	closed  uint32
 	// voterC controls the voting participation
 	voterC chan bool
 	once   sync.Once
+	// detectHealthyInterval is how often a watch loop checks whether it
+	// has seen an event recently
+	detectHealthyInterval time.Duration
+	// watchLoopUnhealthyTimeout is how long a watch loop can go without
+	// delivering an event before it is considered stuck and torn down
+	watchLoopUnhealthyTimeout time.Duration
+	// session is the default Session AddVoter campaigns on
+	session *Session
 }
 
 // NewClient returns a new instance of leader election client
@@ -50,21 +64,34 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, trace.Wrap(err)
 	}
 	return &Client{
-		client: cfg.Client,
-		clock:  cfg.Clock,
-		closeC: make(chan struct{}),
-		pauseC: make(chan bool),
-		voterC: make(chan bool),
+		backend:                   cfg.Backend,
+		clock:                     cfg.Clock,
+		closeC:                    make(chan struct{}),
+		pauseC:                    make(chan bool),
+		voterC:                    make(chan bool),
+		detectHealthyInterval:     cfg.DetectHealthyInterval,
+		watchLoopUnhealthyTimeout: cfg.WatchLoopUnhealthyTimeout,
 	}, nil
 }
 
 func (r *Config) checkAndSetDefaults() error {
-	if r.Client == nil {
-		return trace.BadParameter("Client is required")
+	if r.Backend == nil {
+		// fall back to the deprecated etcd v2 Client field so existing
+		// callers keep working unchanged
+		if r.Client == nil {
+			return trace.BadParameter("Backend or Client is required")
+		}
+		r.Backend = etcdv2.New(r.Client)
 	}
 	if r.Clock == nil {
 		r.Clock = clockwork.NewRealClock()
 	}
+	if r.DetectHealthyInterval == 0 {
+		r.DetectHealthyInterval = defaultDetectHealthyInterval
+	}
+	if r.WatchLoopUnhealthyTimeout == 0 {
+		r.WatchLoopUnhealthyTimeout = defaultWatchLoopUnhealthyTimeout
+	}
 	return nil
 }
 
@@ -72,14 +99,36 @@ func (r *Config) checkAndSetDefaults() error {
 type Config struct {
 	// Clock is a time provider
 	Clock clockwork.Clock
-	// Client is ETCD client will be used if passed
+	// Backend is the storage backend election, voting and watch loops run
+	// against. Takes precedence over Client if both are set.
+	Backend backend.Backend
+	// Client is the etcd v2 client to use if Backend is not set.
+	//
+	// Deprecated: set Backend instead, e.g. via backend/etcdv2.New or
+	// backend/etcdv3.New. Client is kept only so existing call sites
+	// compile unchanged.
 	Client client.Client
+	// DetectHealthyInterval is how often a watch loop checks whether it
+	// has seen a watch event recently. Defaults to 10 seconds.
+	DetectHealthyInterval time.Duration
+	// WatchLoopUnhealthyTimeout is how long a watch loop can go without
+	// delivering an event before it is considered stuck, probed and torn
+	// down. Defaults to 60 seconds.
+	WatchLoopUnhealthyTimeout time.Duration
 }
 
 // CallbackFn specifies callback that is called by AddWatchCallback
 // whenever leader changes
 type CallbackFn func(key, prevValue, newValue string)
 
+// errWatchClosing is returned internally by addWatch's newWatch helper to
+// signal that getWatchAtLatestIndex came back empty because ctx or the
+// client is closing, not because of a real backend error. Routing it
+// through the normal err != nil handling (which already checks ctx.Err())
+// keeps addWatch's main loop from mistaking a nil watcher/nil KeyValue for
+// a successful watch and dereferencing kv.
+var errWatchClosing = errors.New("watch closing")
+
 // AddWatchCallback adds the given callback to be invoked when changes are
 // made to the specified key's value. The callback is called with new and
 // previous values for the key. In the first call, both values are the same
@@ -101,38 +150,100 @@ func (l *Client) AddWatchCallback(key string, retry time.Duration, fn CallbackFn
 	}()
 }
 
+// watchUpdate is what addWatch delivers internally. AddWatch's public API
+// predates the backend.Backend revision and only ever needed the value,
+// but Observe also needs the revision the update corresponds to.
+type watchUpdate struct {
+	Value    string
+	Revision int64
+}
+
 // AddWatch starts watching the key for changes and sending them
 // to the valuesC, the watch is stopped
 func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string) {
+	updatesC := make(chan watchUpdate)
+	go func() {
+		for {
+			select {
+			case update := <-updatesC:
+				select {
+				case valuesC <- update.Value:
+				case <-l.closeC:
+					return
+				}
+			case <-l.closeC:
+				return
+			}
+		}
+	}()
+	// suppress empty (expired/deleted) values: existing AddWatch callers
+	// only ever dealt with a value actually being set
+	l.addWatch(context.Background(), key, retry, updatesC, true)
+}
+
+// addWatch is the shared implementation behind AddWatch and Observe.
+// When suppressEmpty is true, a key expiring with no successor is silently
+// skipped, matching AddWatch's historical behavior. When false, it is
+// delivered as an empty value so callers such as Observe can tell a lost
+// leader apart from "nothing has changed yet".
+//
+// parentCtx bounds the watch in addition to l.closeC, so a caller such as
+// Observe that hands in a context shorter-lived than the Client can tear
+// its own watch down without waiting for the Client itself to close.
+func (l *Client) addWatch(parentCtx context.Context, key string, retry time.Duration, updatesC chan watchUpdate, suppressEmpty bool) {
 	prefix := fmt.Sprintf("AddWatch(key=%v)", key)
-	api := client.NewKeysAPI(l.client)
 
 	go func() {
-		var watcher client.Watcher
-		var resp *client.Response
+		var watcher backend.Watch
+		var watchCtx context.Context
+		var watchCancel context.CancelFunc
+		var kv *backend.KeyValue
 		var err error
 
 		ctx, closer := context.WithCancel(context.WithValue(context.Background(), "prefix", prefix))
 		go func() {
-			<-l.closeC
+			select {
+			case <-l.closeC:
+			case <-parentCtx.Done():
+			}
 			closer()
 		}()
 
+		monitor := newWatchMonitor(l, ctx, prefix, key)
+		defer monitor.stop()
+
+		newWatch := func() (backend.Watch, *backend.KeyValue, error) {
+			watchCtx, watchCancel = context.WithCancel(ctx)
+			w, kv, err := l.getWatchAtLatestIndex(watchCtx, key, retry)
+			if err == nil && w == nil && kv == nil {
+				// ctx or the client is closing; see errWatchClosing
+				return nil, nil, errWatchClosing
+			}
+			if err == nil {
+				monitor.touch()
+				monitor.setCancel(watchCancel)
+			}
+			return w, kv, err
+		}
+
 		b := NewUnlimitedExponentialBackOff()
 		ticker := backoff.NewTicker(b)
+		defer ticker.Stop()
 		var steps int
 
-		watcher, resp, err = l.getWatchAtLatestIndex(ctx, api, key, retry)
+		watcher, kv, err = newWatch()
 		if err != nil {
 			return
 		}
 
 		// make sure we always send the first actual value
-		if resp != nil && resp.Node != nil {
+		if kv != nil {
 			select {
-			case valuesC <- resp.Node.Value:
+			case updatesC <- watchUpdate{Value: kv.Value, Revision: kv.Revision}:
 			case <-l.closeC:
 				return
+			case <-ctx.Done():
+				return
 			}
 		}
 
@@ -140,13 +251,14 @@ func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string)
 		for {
 
 			if watcher == nil {
-				watcher, resp, err = l.getWatchAtLatestIndex(ctx, api, key, retry)
+				watcher, kv, err = newWatch()
 			}
 
 			if watcher != nil {
-				resp, err = watcher.Next(ctx)
+				kv, err = watcher.Next(watchCtx)
 				if err == nil {
-					if resp.Node.Value == "" {
+					monitor.touch()
+					if kv.Value == "" && suppressEmpty {
 						continue
 					}
 					b.Reset()
@@ -154,22 +266,30 @@ func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string)
 			}
 
 			if err != nil {
+				if ctx.Err() != nil {
+					// the client is closing
+					return
+				}
+				if watchCtx.Err() != nil {
+					// watchCtx was cancelled by the health monitor because
+					// the watch looked stuck. The backend may return this
+					// as context.Canceled, a wrapped trace error, or a
+					// backend-specific error (e.g. etcdv3's "watch
+					// closed"), so check watchCtx directly rather than
+					// trying to match on err: tear it down and reconnect.
+					log.Debugf("%v watch looks stuck, reconnecting", prefix)
+					watcher = nil
+					continue
+				}
+
 				select {
 				case <-ticker.C:
 					steps += 1
 				}
 
-				if err == context.Canceled {
-					return
-				} else if cerr, ok := err.(*client.ClusterError); ok {
-					if len(cerr.Errors) != 0 && cerr.Errors[0] == context.Canceled {
-						return
-					}
-					log.Debugf("unexpected cluster error: %v (%v)", err, cerr.Detail())
-					continue
-				} else if IsWatchExpired(err) {
+				if trace.IsCompareFailed(err) {
 					log.Debug("watch expired, resetting watch index")
-					watcher, resp, err = l.getWatchAtLatestIndex(ctx, api, key, retry)
+					watcher, kv, err = newWatch()
 					if err != nil {
 						continue
 					}
@@ -177,7 +297,7 @@ func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string)
 					log.Warningf("unexpected watch error: %v", err)
 					// try recreating the watch if we get repeated unknown errors
 					if steps > 10 {
-						watcher, resp, err = l.getWatchAtLatestIndex(ctx, api, key, retry)
+						watcher, kv, err = newWatch()
 						if err != nil {
 							continue
 						}
@@ -190,14 +310,16 @@ func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string)
 			}
 			// if nothing has changed and we previously sent this subscriber this value,
 			// do not bother subscriber with extra notifications
-			if resp.PrevNode != nil && resp.PrevNode.Value == resp.Node.Value && sentAnything {
+			if kv.PrevValue == kv.Value && sentAnything {
 				continue
 			}
 			select {
-			case valuesC <- resp.Node.Value:
+			case updatesC <- watchUpdate{Value: kv.Value, Revision: kv.Revision}:
 				sentAnything = true
 			case <-l.closeC:
 				return
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -208,7 +330,13 @@ func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string)
 // The time-to-live value cannot be less than a second.
 // After successfully setting the key, it attempts to renew the lease for the specified
 // term indefinitely.
-// The method is idempotent and does nothing if invoked multiple times
+// The method is idempotent and does nothing if invoked multiple times.
+//
+// AddVoter is sugar over a default Session owned by the client: it is
+// equivalent to creating a Session with NewSession (Term set to term) and calling
+// Campaign on it. Callers that need to observe lease loss, or that want
+// to bind several elections to a single TTL so a partition drops all of
+// them together, should create their own Session instead.
 func (l *Client) AddVoter(ctx context.Context, key, value string, term time.Duration) {
 	l.once.Do(func() {
 		l.startVoterLoop(key, value, term)
@@ -242,137 +370,141 @@ func (l *Client) Close() error {
 	return nil
 }
 
-// startVoterLoop starts a process that attempts to set the specified key to
-// to the given value with the time-to-live value specified with term.
-// The time-to-live value cannot be less than a second.
-// After successfully setting the key, it attempts to renew the lease for the specified
-// term indefinitely.
+// startVoterLoop creates the default Session for this client and campaigns
+// on it for key/value, then reacts to pauseC/voterC/closeC by resigning and
+// re-campaigning as before -- the periodic lease renewal itself now lives
+// in the Session's own keepalive goroutine instead of a loop here.
 func (l *Client) startVoterLoop(key, value string, term time.Duration) {
+	session, err := NewSession(SessionConfig{Backend: l.backend, Clock: l.clock, Term: term})
+	if err != nil {
+		log.WithError(err).Warn("Voter error: failed to create session.")
+		return
+	}
+	l.session = session
+
+	if err := session.Campaign(context.Background(), key, value); err != nil {
+		log.WithError(err).Warn("Voter error.")
+	}
+
 	go func() {
-		err := l.elect(key, value, term)
-		if err != nil {
-			log.WithError(err).Warn("Voter error.")
-		}
-		ticker := time.NewTicker(term / 5)
-		tickerC := ticker.C
 		for {
 			select {
 			case <-l.pauseC:
 				log.Info("Step down.")
+				session.Resign(context.Background(), key)
+				pauseTimer := timerpool.Get(term * 2)
 				select {
-				case <-time.After(term * 2):
+				case <-pauseTimer.C:
+					timerpool.Put(pauseTimer)
+					if err := session.Campaign(context.Background(), key, value); err != nil {
+						log.WithError(err).Warn("Voter error.")
+					}
 				case <-l.closeC:
+					timerpool.Put(pauseTimer)
+					session.Close()
 					return
 				}
-			default:
-			}
-
-			select {
-			case <-tickerC:
-				err := l.elect(key, value, term)
-				if err != nil {
-					log.WithError(err).Warn("Voter error.")
-				}
 
 			case enabled := <-l.voterC:
 				if !enabled {
-					if ticker != nil {
-						ticker.Stop()
-					}
-					ticker = nil
-					tickerC = nil
+					session.Resign(context.Background(), key)
 					continue
 				}
-				if tickerC == nil {
-					ticker = time.NewTicker(term / 5)
-					tickerC = ticker.C
+				if err := session.Campaign(context.Background(), key, value); err != nil {
+					log.WithError(err).Warn("Voter error.")
 				}
 
-			case <-l.closeC:
-				if ticker != nil {
-					ticker.Stop()
+			case <-session.Done():
+				log.Warning("Voter session lease lost, starting a new session.")
+				session, err = NewSession(SessionConfig{Backend: l.backend, Clock: l.clock, Term: term})
+				if err != nil {
+					log.WithError(err).Warn("Voter error: failed to create session.")
+					return
 				}
+				l.session = session
+				if err := session.Campaign(context.Background(), key, value); err != nil {
+					log.WithError(err).Warn("Voter error.")
+				}
+
+			case <-l.closeC:
+				session.Close()
 				return
 			}
 		}
 	}()
 }
 
-func (l *Client) getWatchAtLatestIndex(ctx context.Context, api client.KeysAPI, key string, retry time.Duration) (client.Watcher, *client.Response, error) {
-	resp, err := l.getFirstValue(key, retry)
+func (l *Client) getWatchAtLatestIndex(ctx context.Context, key string, retry time.Duration) (backend.Watch, *backend.KeyValue, error) {
+	kv, err := l.getFirstValue(ctx, key, retry)
 	if err != nil {
 		return nil, nil, trace.BadParameter("%v unexpected error: %v", ctx.Value("prefix"), err)
-	} else if resp == nil {
+	} else if kv == nil {
 		log.Debugf("%v client is closing, return", ctx.Value("prefix"))
 		return nil, nil, nil
 	}
-	log.Debugf("%v got current value '%v' for key '%v'", ctx.Value("prefix"), resp.Node.Value, key)
-	watcher := api.Watcher(key, &client.WatcherOptions{
-		// Response.Index corresponds to X-Etcd-Index response header field
-		// and is the recommended starting point after a history miss of over
-		// 1000 events
-		AfterIndex: resp.Index,
-	})
-	return watcher, resp, nil
+	log.Debugf("%v got current value '%v' for key '%v'", ctx.Value("prefix"), kv.Value, key)
+	watcher, err := l.backend.Watch(ctx, key, kv.Revision)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	return watcher, kv, nil
 }
 
 // getFirstValue returns the current value for key if it exists, or waits
-// for the value to appear and loops until client.Close is called
-func (l *Client) getFirstValue(key string, retryPeriod time.Duration) (*client.Response, error) {
-	api := client.NewKeysAPI(l.client)
-	tick := time.NewTicker(retryPeriod)
-	defer tick.Stop()
+// for the value to appear and loops until ctx is done or client.Close is
+// called
+func (l *Client) getFirstValue(ctx context.Context, key string, retryPeriod time.Duration) (*backend.KeyValue, error) {
 	for {
-		resp, err := api.Get(context.TODO(), key, nil)
+		kv, err := l.backend.Get(ctx, key)
 		if err == nil {
-			return resp, nil
-		} else if !IsNotFound(err) {
+			return kv, nil
+		} else if !trace.IsNotFound(err) {
 			log.Debugf("unexpected watcher error: %v", err)
 		}
+		timer := timerpool.Get(retryPeriod)
 		select {
-		case <-tick.C:
+		case <-timer.C:
+			timerpool.Put(timer)
 		case <-l.closeC:
+			timerpool.Put(timer)
 			log.Debug("watcher got client close signal")
 			return nil, nil
+		case <-ctx.Done():
+			timerpool.Put(timer)
+			log.Debug("watcher got ctx done signal")
+			return nil, nil
 		}
 	}
 }
 
 // elect is taken from: https://github.com/kubernetes/contrib/blob/master/pod-master/podmaster.go
 // this is a slightly modified version though, that does not return the result
-// instead we rely on watchers
-func (l *Client) elect(key, value string, term time.Duration) error {
+// instead we rely on watchers. It is used by Session, both for Campaign and
+// for renewing every key on the session's lease.
+func elect(ctx context.Context, b backend.Backend, clock clockwork.Clock, key, value string, term time.Duration) error {
 	candidate := fmt.Sprintf("candidate(key=%v, value=%v, term=%v)", key, value, term)
-	api := client.NewKeysAPI(l.client)
-	resp, err := api.Get(context.TODO(), key, nil)
+	kv, err := b.Get(ctx, key)
 	if err != nil {
-		if !IsNotFound(err) {
+		if !trace.IsNotFound(err) {
 			return trace.Wrap(err)
 		}
 		// try to grab the lock for the given term
-		_, err := api.Set(context.TODO(), key, value, &client.SetOptions{
-			TTL:       term,
-			PrevExist: client.PrevNoExist,
-		})
+		_, err := b.CompareAndSwap(ctx, key, value, "", term)
 		if err != nil {
 			return trace.Wrap(err)
 		}
 		log.Debugf("%v successfully elected", candidate)
 		return nil
 	}
-	if resp.Node.Value != value {
+	if kv.Value != value {
 		return nil
 	}
-	if resp.Node.Expiration.Sub(l.clock.Now().UTC()) > time.Duration(term/2) {
+	if kv.Expires.Sub(clock.Now().UTC()) > time.Duration(term/2) {
 		return nil
 	}
 
 	// extend the lease before the current expries
-	_, err = api.Set(context.TODO(), key, value, &client.SetOptions{
-		TTL:       term,
-		PrevValue: value,
-		PrevIndex: resp.Node.ModifiedIndex,
-	})
+	_, err = b.CompareAndSwap(ctx, key, value, value, term)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -0,0 +1,102 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// LeaderEvent describes a change in leadership for a key, as delivered by
+// Client.Observe.
+type LeaderEvent struct {
+	// Key is the key being observed
+	Key string
+	// Leader is the currently elected leader's value. It is empty when
+	// the key's lease has expired with no successor, see LostAt.
+	Leader string
+	// Rev is the backend revision this event corresponds to
+	Rev int64
+	// LostAt is the time leadership was lost because the key's lease
+	// expired with no successor taking over. It is the zero time for
+	// every other event, including the first one delivered.
+	LostAt time.Time
+}
+
+// Observe returns a coalesced stream of leadership changes for key,
+// including an explicit event when the key's lease expires with no
+// successor -- the same semantics clientv3/concurrency.Election.Observe
+// provides. It reuses the AddWatch machinery but, unlike AddWatchCallback,
+// does not drop the expiry transition, so followers reliably learn about
+// gaps in leadership instead of just comparing values themselves.
+//
+// The returned channel is closed when ctx is done or the client is closed.
+func (l *Client) Observe(ctx context.Context, key string) <-chan LeaderEvent {
+	updatesC := make(chan watchUpdate)
+	l.addWatch(ctx, key, time.Second, updatesC, false)
+
+	eventsC := make(chan LeaderEvent)
+	go func() {
+		defer close(eventsC)
+		var prev string
+		var sawLeader bool
+		for {
+			select {
+			case <-l.closeC:
+				return
+			case <-ctx.Done():
+				return
+			case update := <-updatesC:
+				event := LeaderEvent{Key: key, Leader: update.Value, Rev: update.Revision}
+				if update.Value == "" && sawLeader {
+					event.LostAt = l.clock.Now().UTC()
+				}
+				sawLeader = sawLeader || update.Value != ""
+				if update.Value == prev {
+					continue
+				}
+				prev = update.Value
+				select {
+				case eventsC <- event:
+				case <-l.closeC:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return eventsC
+}
+
+// WaitLeader blocks until a leader is established for key and returns its
+// value, or returns an error if ctx is done or the client is closed first.
+// It gives followers a first-class way to gate work on "there is currently
+// a live leader" without re-implementing Observe's debouncing themselves.
+func (l *Client) WaitLeader(ctx context.Context, key string) (string, error) {
+	for event := range l.Observe(ctx, key) {
+		if event.Leader != "" {
+			return event.Leader, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return "", trace.ConnectionProblem(nil, "client closed while waiting for a leader on %v", key)
+}
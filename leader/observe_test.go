@@ -0,0 +1,100 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+// notFoundBackend is a backend.Backend whose key never shows up, so
+// getFirstValue's retry loop never returns on its own -- the only way out
+// is ctx being cancelled or the client closing.
+type notFoundBackend struct{}
+
+func (notFoundBackend) Get(ctx context.Context, key string) (*backend.KeyValue, error) {
+	return nil, trace.NotFound("key %v not found", key)
+}
+
+func (notFoundBackend) CompareAndSwap(ctx context.Context, key, value, prevValue string, ttl time.Duration) (*backend.KeyValue, error) {
+	return nil, trace.NotImplemented("notFoundBackend does not support CompareAndSwap")
+}
+
+func (notFoundBackend) Watch(ctx context.Context, key string, revision int64) (backend.Watch, error) {
+	return nil, trace.NotImplemented("notFoundBackend does not support Watch")
+}
+
+func (notFoundBackend) Close() error { return nil }
+
+// TestWaitLeaderReturnsWhenCtxExpires exercises the documented WaitLeader
+// use case of bounding the wait with a ctx: the key never appears, so the
+// underlying addWatch goroutine must be torn down by ctx expiring rather
+// than leaking until Client.Close.
+func TestWaitLeaderReturnsWhenCtxExpires(t *testing.T) {
+	clt, err := NewClient(Config{Backend: notFoundBackend{}, Clock: clockwork.NewRealClock()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer clt.Close()
+
+	runtime.GC()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if _, err := clt.WaitLeader(ctx, "/test/no-leader"); err == nil {
+			cancel()
+			t.Fatal("expected WaitLeader to return an error once ctx expired")
+		}
+		cancel()
+	}
+
+	// give the torn-down addWatch goroutines a moment to actually exit
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		if runtime.NumGoroutine() <= before+1 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("addWatch goroutines leaked: goroutines before=%d after=%d", before, runtime.NumGoroutine())
+}
+
+// TestClientCloseAfterWaitLeaderTimeout guards against the panic this
+// series used to hit: an addWatch goroutine that outlived its ctx and
+// then dereferenced a nil *backend.KeyValue once Client.Close ran.
+func TestClientCloseAfterWaitLeaderTimeout(t *testing.T) {
+	clt, err := NewClient(Config{Backend: notFoundBackend{}, Clock: clockwork.NewRealClock()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	clt.WaitLeader(ctx, "/test/no-leader")
+
+	if err := clt.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/coordinate/internal/timerpool"
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionConfig configures a Session
+type SessionConfig struct {
+	// Backend is the storage backend the session's lease is renewed
+	// against
+	Backend backend.Backend
+	// Clock is a time provider
+	Clock clockwork.Clock
+	// Term is the time-to-live renewed for every key campaigned on this
+	// session. Cannot be less than a second.
+	Term time.Duration
+}
+
+// maxConsecutiveRenewFailures is how many back-to-back renewal rounds are
+// allowed to fail transiently (e.g. a dropped connection or a timeout)
+// before the session gives up and fires Done(). A key is only renewed once
+// less than term/2 of its lease remains, so by the third failed round on
+// term/5 ticks at most a tenth of the term is left on the lease.
+const maxConsecutiveRenewFailures = 3
+
+func (r *SessionConfig) checkAndSetDefaults() error {
+	if r.Backend == nil {
+		return trace.BadParameter("Backend is required")
+	}
+	if r.Term < time.Second {
+		return trace.BadParameter("Term cannot be less than a second")
+	}
+	if r.Clock == nil {
+		r.Clock = clockwork.NewRealClock()
+	}
+	return nil
+}
+
+// Session groups one or more elections under a single renewal lease,
+// modeled on clientv3/concurrency.Session. Unlike the default Session that
+// AddVoter keeps private to the Client, a Session created with NewSession
+// runs a single keepalive goroutine for every key Campaigned on it and
+// exposes Done(), which fires the instant the lease can no longer be
+// renewed -- for example because of a network partition -- so every key
+// on the session loses leadership atomically and visibly.
+type Session struct {
+	cfg SessionConfig
+
+	mu      sync.Mutex
+	entries map[string]string
+
+	doneC    chan struct{}
+	doneOnce sync.Once
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSession creates and starts a new Session. The session's keepalive
+// goroutine runs until Close is called or the lease is lost (see Done).
+func NewSession(cfg SessionConfig) (*Session, error) {
+	if err := cfg.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	s := &Session{
+		cfg:     cfg,
+		entries: make(map[string]string),
+		doneC:   make(chan struct{}),
+		stopC:   make(chan struct{}),
+	}
+	go s.keepAliveLoop()
+	return s, nil
+}
+
+// Campaign registers key/value with the session, attempting to win (or
+// extend) the election for key right away, bounded by ctx. Subsequent
+// renewals happen on the session's single keepalive goroutine, alongside
+// any other key Campaigned on the same session, and are not bound by ctx.
+func (s *Session) Campaign(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	s.entries[key] = value
+	s.mu.Unlock()
+	return elect(ctx, s.cfg.Backend, s.cfg.Clock, key, value, s.cfg.Term)
+}
+
+// Resign removes key from the session so it is no longer renewed. The key
+// itself is left for the backend's lease to expire naturally; Resign only
+// stops this session from extending it further. ctx is accepted for
+// parity with clientv3/concurrency.Election.Resign and future use should
+// Resign ever need to talk to the backend to release the key early.
+func (s *Session) Resign(ctx context.Context, key string) {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+}
+
+// Done returns a channel that is closed once the session's lease is lost:
+// either Close was called, a renewal failed because another candidate
+// changed the key, or maxConsecutiveRenewFailures renewal rounds in a row
+// failed with a transient error. At that
+// point every key Campaigned on the session has lost its leadership.
+func (s *Session) Done() <-chan struct{} {
+	return s.doneC
+}
+
+// Close stops the session's keepalive goroutine and fires Done().
+func (s *Session) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stopC)
+	})
+}
+
+func (s *Session) keepAliveLoop() {
+	defer s.fireDone()
+	timer := timerpool.Get(s.cfg.Term / 5)
+	defer timerpool.Put(timer)
+	var failures int
+	for {
+		select {
+		case <-timer.C:
+			ok, lost := s.renewAll()
+			switch {
+			case ok:
+				failures = 0
+			case lost:
+				// a renewal definitively failed, e.g. another candidate
+				// already holds the key: no amount of retrying recovers it
+				return
+			default:
+				// a transient error (dropped connection, timeout): give
+				// the lease's remaining term/2 grace window a chance to
+				// recover on its own before giving up on it
+				failures++
+				if failures >= maxConsecutiveRenewFailures {
+					log.Warnf("Session failed to renew %v consecutive times, lease lost.", failures)
+					return
+				}
+			}
+			timer.Reset(s.cfg.Term / 5)
+		case <-s.stopC:
+			return
+		}
+	}
+}
+
+// renewAll renews every key currently registered on the session. It
+// returns ok=true if every key renewed cleanly. Otherwise lost reports
+// whether the failure is definitive -- the key is confirmed held by
+// someone else -- as opposed to a transient backend error that is worth
+// retrying on the next tick; see maxConsecutiveRenewFailures.
+func (s *Session) renewAll() (ok, lost bool) {
+	s.mu.Lock()
+	entries := make(map[string]string, len(s.entries))
+	for k, v := range s.entries {
+		entries[k] = v
+	}
+	s.mu.Unlock()
+
+	for key, value := range entries {
+		if err := elect(context.Background(), s.cfg.Backend, s.cfg.Clock, key, value, s.cfg.Term); err != nil {
+			if trace.IsCompareFailed(err) {
+				log.WithError(err).Warnf("Session lost %v to another candidate.", key)
+				return false, true
+			}
+			log.WithError(err).Warnf("Session failed to renew %v.", key)
+			return false, false
+		}
+	}
+	return true, false
+}
+
+func (s *Session) fireDone() {
+	s.doneOnce.Do(func() {
+		close(s.doneC)
+	})
+}
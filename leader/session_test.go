@@ -0,0 +1,184 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/coordinate/leader/backend"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+// fakeBackend is a minimal, single-key backend.Backend for exercising
+// Session's renewal logic without a real etcd. errs, if non-empty, is
+// consumed one error per CompareAndSwap call before renewals start
+// succeeding again -- it lets tests simulate a run of transient failures.
+type fakeBackend struct {
+	clock clockwork.Clock
+
+	mu   sync.Mutex
+	kv   *backend.KeyValue
+	errs []error
+}
+
+func (b *fakeBackend) Get(ctx context.Context, key string) (*backend.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.kv == nil {
+		return nil, trace.NotFound("key %v not found", key)
+	}
+	kv := *b.kv
+	return &kv, nil
+}
+
+func (b *fakeBackend) CompareAndSwap(ctx context.Context, key, value, prevValue string, ttl time.Duration) (*backend.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.errs) > 0 {
+		err := b.errs[0]
+		b.errs = b.errs[1:]
+		return nil, err
+	}
+	b.kv = &backend.KeyValue{Key: key, Value: value, Expires: b.clock.Now().Add(ttl)}
+	return b.kv, nil
+}
+
+func (b *fakeBackend) Watch(ctx context.Context, key string, revision int64) (backend.Watch, error) {
+	return nil, trace.NotFound("fakeBackend does not support Watch")
+}
+
+func (b *fakeBackend) Close() error { return nil }
+
+func TestSessionConfigValidation(t *testing.T) {
+	_, err := NewSession(SessionConfig{Term: time.Second})
+	if !trace.IsBadParameter(err) {
+		t.Errorf("expected a BadParameter error for a missing Backend, got %v", err)
+	}
+
+	_, err = NewSession(SessionConfig{Backend: &fakeBackend{}, Term: time.Millisecond})
+	if !trace.IsBadParameter(err) {
+		t.Errorf("expected a BadParameter error for a sub-second Term, got %v", err)
+	}
+}
+
+func TestSessionToleratesTransientRenewFailures(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	term := time.Second
+	b := &fakeBackend{clock: clock}
+	s, err := NewSession(SessionConfig{Backend: b, Clock: clock, Term: term})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Campaign(context.Background(), "key", "value"); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+
+	// advance the clock so the next keepalive tick actually attempts a
+	// renewal instead of seeing the lease as freshly extended
+	clock.Advance(term)
+
+	b.mu.Lock()
+	b.errs = []error{errors.New("transient: connection reset"), errors.New("transient: timeout")}
+	b.mu.Unlock()
+
+	select {
+	case <-s.Done():
+		t.Fatal("session gave up after fewer than maxConsecutiveRenewFailures transient errors")
+	case <-time.After(term):
+	}
+}
+
+func TestSessionGivesUpAfterRepeatedTransientFailures(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	term := time.Second
+	b := &fakeBackend{clock: clock}
+	s, err := NewSession(SessionConfig{Backend: b, Clock: clock, Term: term})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Campaign(context.Background(), "key", "value"); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	clock.Advance(term)
+
+	b.mu.Lock()
+	b.errs = []error{
+		errors.New("transient: 1"),
+		errors.New("transient: 2"),
+		errors.New("transient: 3"),
+		errors.New("transient: 4"),
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-s.Done():
+	case <-time.After(2 * term):
+		t.Fatal("session never gave up despite repeated consecutive transient failures")
+	}
+}
+
+func TestSessionFiresDoneWhenKeyTakenByAnotherCandidate(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	term := time.Second
+	b := &fakeBackend{clock: clock}
+	s, err := NewSession(SessionConfig{Backend: b, Clock: clock, Term: term})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Campaign(context.Background(), "key", "value"); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	clock.Advance(term)
+
+	b.mu.Lock()
+	b.errs = []error{trace.CompareFailed("key was taken by another candidate")}
+	b.mu.Unlock()
+
+	select {
+	case <-s.Done():
+	case <-time.After(term):
+		t.Fatal("session did not fire Done immediately after losing the key to another candidate")
+	}
+}
+
+func TestSessionCloseFiresDone(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	b := &fakeBackend{clock: clock}
+	s, err := NewSession(SessionConfig{Backend: b, Clock: clock, Term: time.Second})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	s.Close()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Close did not fire Done")
+	}
+}